@@ -0,0 +1,201 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// dumpWorkerCount bounds how many GVRs are dumped concurrently so a
+	// single hung resource can't stall the rest of the dump.
+	dumpWorkerCount = 10
+	// dumpResourceTimeout bounds how long a single GVR is given to list and
+	// write out its objects before it's abandoned.
+	dumpResourceTimeout = 2 * time.Minute
+)
+
+// metadataOnlyResources are dumped via the metadata-only codec path because
+// their full objects tend to be enormous on busy clusters and aren't useful
+// for post-mortem debugging anyway.
+var metadataOnlyResources = map[string]bool{
+	"events":    true,
+	"endpoints": true,
+}
+
+// dumpDiscoveredResources uses discovery to enumerate every namespaced
+// resource the guest apiserver allows to be listed and fetched, at its
+// group's preferred version only, and writes one YAML file per
+// object under dumpDir/<group>/<version>/<resource>/<namespace>/<name>.yaml.
+// Pod objects additionally get their container logs dumped alongside them.
+// This lets a failed test capture the full guest cluster state without
+// hard-coding a list of resources to collect.
+func dumpDiscoveredResources(ctx context.Context, t *testing.T, guestConfig *rest.Config, dumpDir string) error {
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(guestConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create discovery client: %w", err)
+	}
+	dynamicClient, err := dynamic.NewForConfig(guestConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create dynamic client: %w", err)
+	}
+	metadataClient, err := metadata.NewForConfig(guestConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create metadata client: %w", err)
+	}
+	kubeClient, err := kubernetes.NewForConfig(guestConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create kube client: %w", err)
+	}
+
+	apiResourceLists, err := discoveryClient.ServerPreferredResources()
+	if err != nil && len(apiResourceLists) == 0 {
+		return fmt.Errorf("failed to discover server resources: %w", err)
+	}
+	apiResourceLists = discovery.FilteredBy(discovery.SupportsAllVerbs{Verbs: []string{"list", "get"}}, apiResourceLists)
+	gvrs, err := discovery.GroupVersionResources(apiResourceLists)
+	if err != nil {
+		return fmt.Errorf("failed to parse discovered group versions: %w", err)
+	}
+
+	namespacedGVRs := namespacedResources(apiResourceLists, gvrs)
+
+	work := make(chan schema.GroupVersionResource, len(namespacedGVRs))
+	for _, gvr := range namespacedGVRs {
+		work <- gvr
+	}
+	close(work)
+
+	var wg sync.WaitGroup
+	for i := 0; i < dumpWorkerCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for gvr := range work {
+				resourceCtx, cancel := context.WithTimeout(ctx, dumpResourceTimeout)
+				if err := dumpResource(resourceCtx, dynamicClient, metadataClient, kubeClient, gvr, dumpDir); err != nil {
+					t.Logf("Failed to dump resource %s: %v", gvr, err)
+				}
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return nil
+}
+
+// namespacedResources filters discovered resources down to the GVRs that are
+// namespace-scoped; cluster-scoped resources (nodes, namespaces themselves,
+// etc.) are already covered by core.DumpGuestCluster.
+func namespacedResources(apiResourceLists []*metav1.APIResourceList, gvrs map[schema.GroupVersionResource]struct{}) []schema.GroupVersionResource {
+	var result []schema.GroupVersionResource
+	for _, list := range apiResourceLists {
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
+		if err != nil {
+			continue
+		}
+		for _, resource := range list.APIResources {
+			if !resource.Namespaced {
+				continue
+			}
+			gvr := gv.WithResource(resource.Name)
+			if _, ok := gvrs[gvr]; ok {
+				result = append(result, gvr)
+			}
+		}
+	}
+	return result
+}
+
+func dumpResource(ctx context.Context, dynamicClient dynamic.Interface, metadataClient metadata.Interface, kubeClient kubernetes.Interface, gvr schema.GroupVersionResource, dumpDir string) error {
+	resourceDir := filepath.Join(dumpDir, gvr.Group, gvr.Version, gvr.Resource)
+
+	if metadataOnlyResources[gvr.Resource] {
+		list, err := metadataClient.Resource(gvr).Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to list %s: %w", gvr, err)
+		}
+		for i := range list.Items {
+			item := &list.Items[i]
+			if err := writeObject(item, resourceDir, item.Namespace, item.Name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	list, err := dynamicClient.Resource(gvr).Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list %s: %w", gvr, err)
+	}
+	for i := range list.Items {
+		obj := &list.Items[i]
+		if err := writeObject(obj, resourceDir, obj.GetNamespace(), obj.GetName()); err != nil {
+			return err
+		}
+		if gvr.Resource == "pods" {
+			if err := dumpPodLogs(ctx, kubeClient, obj, resourceDir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeObject(obj runtime.Object, resourceDir, namespace, name string) error {
+	dir := filepath.Join(resourceDir, namespace)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create dir %s: %w", dir, err)
+	}
+	data, err := yaml.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s/%s: %w", namespace, name, err)
+	}
+	return ioutil.WriteFile(filepath.Join(dir, name+".yaml"), data, 0644)
+}
+
+// dumpPodLogs writes each container's logs under
+// <resourceDir>/<namespace>/<name>/logs/<container>.log, alongside the pod's
+// own YAML dump.
+func dumpPodLogs(ctx context.Context, kubeClient kubernetes.Interface, obj *unstructured.Unstructured, resourceDir string) error {
+	var pod corev1.Pod
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &pod); err != nil {
+		return fmt.Errorf("failed to convert pod %s/%s: %w", obj.GetNamespace(), obj.GetName(), err)
+	}
+
+	logDir := filepath.Join(resourceDir, pod.Namespace, pod.Name, "logs")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return fmt.Errorf("failed to create log dir %s: %w", logDir, err)
+	}
+
+	for _, container := range pod.Spec.Containers {
+		logs, err := kubeClient.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{Container: container.Name}).DoRaw(ctx)
+		if err != nil {
+			// The container may not have started yet or may no longer exist;
+			// this is best-effort so keep going with the rest of the dump.
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(logDir, container.Name+".log"), logs, 0644); err != nil {
+			return fmt.Errorf("failed to write logs for %s/%s container %s: %w", pod.Namespace, pod.Name, container.Name, err)
+		}
+	}
+	return nil
+}
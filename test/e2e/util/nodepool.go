@@ -0,0 +1,37 @@
+package util
+
+import (
+	"context"
+	"fmt"
+
+	capiv1 "sigs.k8s.io/cluster-api/api/v1alpha4"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	crclient "sigs.k8s.io/controller-runtime/pkg/client"
+
+	hyperv1 "github.com/openshift/hypershift/api/v1alpha1"
+	"github.com/openshift/hypershift/hypershift-operator/controllers/manifests"
+)
+
+// nodePoolGuestNodeNames returns the names of the guest Nodes backing a
+// NodePool, determined by cross-referencing the cluster-api Machines its
+// MachineDeployment owns rather than a label on the Node itself: nothing in
+// the NodePool controller mirrors the NodePool's identity onto the guest
+// Node, so this is the only way e2e code can scope guest nodes to a single
+// NodePool today.
+func nodePoolGuestNodeNames(ctx context.Context, hostClient crclient.Client, nodepool *hyperv1.NodePool) (sets.String, error) {
+	hcpNamespace := manifests.HostedControlPlaneNamespace(nodepool.Namespace, nodepool.Spec.ClusterName).Name
+
+	var machines capiv1.MachineList
+	if err := hostClient.List(ctx, &machines, crclient.InNamespace(hcpNamespace), crclient.MatchingLabels{capiv1.MachineDeploymentLabelName: nodepool.Name}); err != nil {
+		return nil, fmt.Errorf("failed to list machines for nodepool %s/%s: %w", nodepool.Namespace, nodepool.Name, err)
+	}
+
+	names := sets.NewString()
+	for _, machine := range machines.Items {
+		if machine.Status.NodeRef != nil {
+			names.Insert(machine.Status.NodeRef.Name)
+		}
+	}
+	return names, nil
+}
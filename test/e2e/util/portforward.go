@@ -0,0 +1,133 @@
+package util
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"testing"
+	"time"
+
+	hyperv1 "github.com/openshift/hypershift/api/v1alpha1"
+	"github.com/openshift/hypershift/hypershift-operator/controllers/manifests"
+	"k8s.io/client-go/rest"
+)
+
+// guestAPIServerProbeTimeout bounds the fast TCP probe WaitForGuestClient
+// uses to decide whether it needs to fall back to a port-forwarded
+// connection.
+const guestAPIServerProbeTimeout = 2 * time.Second
+
+// portForwardTimeout bounds how long we wait for `kubectl port-forward` to
+// report the local port it bound before giving up.
+const portForwardTimeout = 30 * time.Second
+
+var portForwardAddrRegexp = regexp.MustCompile(`Forwarding from (?:127\.0\.0\.1|\[::1\]):(\d+) ->`)
+
+// guestAPIServerReachable does a fast TCP dial against the guest
+// kubeconfig's server URL to decide whether WaitForGuestClient needs to fall
+// back to a port-forwarded connection. Clusters whose guest apiserver is
+// only reachable from inside the management cluster's network fail this
+// probe quickly instead of waiting out the full connection timeout on a
+// direct dial that was never going to succeed.
+func guestAPIServerReachable(serverURL string) bool {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return false
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, guestAPIServerProbeTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// portForwardGuestAPIServer starts `kubectl port-forward` against the
+// kube-apiserver service in the HostedControlPlane's namespace on the
+// management cluster and returns a copy of guestConfig rewritten to dial
+// through the resulting local port instead of the guest apiserver's real,
+// unreachable address. This is the classic Kubernetes e2e workaround for
+// exercising a cluster whose apiserver is only reachable from inside
+// another network. The returned func stops the port-forward and must be
+// called once the caller is done with the returned config.
+func portForwardGuestAPIServer(t *testing.T, ctx context.Context, hostedCluster *hyperv1.HostedCluster, guestConfig *rest.Config) (*rest.Config, func(), error) {
+	namespace := manifests.HostedControlPlaneNamespace(hostedCluster.Namespace, hostedCluster.Name).Name
+
+	forwardCtx, cancel := context.WithCancel(ctx)
+	cmd := exec.CommandContext(forwardCtx, "kubectl", "port-forward", fmt.Sprintf("--namespace=%s", namespace), "svc/kube-apiserver", ":6443")
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		cancel()
+		return nil, nil, fmt.Errorf("failed to open kubectl port-forward stderr: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, nil, fmt.Errorf("failed to start kubectl port-forward: %w", err)
+	}
+	stderrDone := make(chan struct{})
+	cleanup := func() {
+		cancel()
+		select {
+		case <-stderrDone:
+		case <-time.After(portForwardTimeout):
+			// The stderr scan should finish quickly once the process is
+			// killed; don't block the caller forever if it somehow doesn't.
+		}
+		_ = cmd.Wait()
+	}
+
+	portCh := make(chan string, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		// Keep draining stderr for the life of the process: kubectl writes a
+		// line per tunneled connection ("Handling connection for ..."), and
+		// returning after the first match would leave those unread, filling
+		// the pipe buffer and eventually blocking kubectl's writes, silently
+		// stalling the tunnel. cmd.Wait must not run until this scan loop has
+		// finished reading, so cleanup waits on stderrDone before calling it.
+		defer close(stderrDone)
+		portSent := false
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			line := scanner.Text()
+			t.Logf("kubectl port-forward: %s", line)
+			if portSent {
+				continue
+			}
+			if match := portForwardAddrRegexp.FindStringSubmatch(line); match != nil {
+				portCh <- match[1]
+				portSent = true
+			}
+		}
+		if !portSent {
+			errCh <- fmt.Errorf("kubectl port-forward exited before reporting a local port: %w", scanner.Err())
+		}
+	}()
+
+	var localPort string
+	select {
+	case localPort = <-portCh:
+	case err := <-errCh:
+		cleanup()
+		return nil, nil, err
+	case <-time.After(portForwardTimeout):
+		cleanup()
+		return nil, nil, fmt.Errorf("timed out waiting for kubectl port-forward to report a local port")
+	}
+
+	tunneledConfig := rest.CopyConfig(guestConfig)
+	tunneledConfig.Host = fmt.Sprintf("https://127.0.0.1:%s", localPort)
+	// The tunnel terminates at the real guest apiserver's certificate, which
+	// isn't valid for 127.0.0.1, so skip verification rather than require
+	// the caller to inject a matching SNI.
+	tunneledConfig.TLSClientConfig.Insecure = true
+	tunneledConfig.TLSClientConfig.CAData = nil
+	tunneledConfig.TLSClientConfig.CAFile = ""
+
+	return tunneledConfig, cleanup, nil
+}
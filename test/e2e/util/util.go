@@ -20,7 +20,6 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 
 	"k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/util/wait"
 	crclient "sigs.k8s.io/controller-runtime/pkg/client"
 
 	hyperv1 "github.com/openshift/hypershift/api/v1alpha1"
@@ -29,36 +28,38 @@ import (
 
 // DeleteNamespace deletes and finalizes the given namespace, logging any failures
 // along the way.
-func DeleteNamespace(t *testing.T, ctx context.Context, client crclient.Client, namespace string) error {
+func DeleteNamespace(t *testing.T, ctx context.Context, client crclient.Client, namespace string, timeout time.Duration) error {
+	waiter := NewWaiter(timeout, 5*time.Second).WithObserver(DefaultObserver)
+
 	t.Logf("Deleting namespace: %s", namespace)
-	err := wait.PollImmediateUntil(5*time.Second, func() (bool, error) {
+	err := waiter.Poll(t, ctx, "namespace deleted", func() (bool, string, error) {
 		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}
 		err := client.Delete(ctx, ns, &crclient.DeleteOptions{})
 		if err != nil {
 			if errors.IsNotFound(err) {
-				return true, nil
+				return true, "deleted", nil
 			}
 			t.Logf("Failed to delete namespace: %s, will retry: %v", namespace, err)
-			return false, nil
+			return false, err.Error(), nil
 		}
-		return true, nil
-	}, ctx.Done())
+		return true, "deleted", nil
+	})
 	if err != nil {
 		return fmt.Errorf("failed to delete namespace: %w", err)
 	}
 
 	t.Logf("Waiting for namespace to be finalized. Namespace: %s", namespace)
-	err = wait.PollImmediateUntil(5*time.Second, func() (done bool, err error) {
+	err = waiter.Poll(t, ctx, "namespace finalized", func() (bool, string, error) {
 		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}
 		if err := client.Get(ctx, crclient.ObjectKeyFromObject(ns), ns); err != nil {
 			if errors.IsNotFound(err) {
-				return true, nil
+				return true, "finalized", nil
 			}
 			t.Logf("Failed to get namespace: %s. %v", namespace, err)
-			return false, nil
+			return false, err.Error(), nil
 		}
-		return false, nil
-	}, ctx.Done())
+		return false, string(ns.Status.Phase), nil
+	})
 	if err != nil {
 		return fmt.Errorf("namespace still exists after deletion timeout: %v", err)
 	}
@@ -66,27 +67,28 @@ func DeleteNamespace(t *testing.T, ctx context.Context, client crclient.Client,
 	return nil
 }
 
-func WaitForGuestKubeConfig(t *testing.T, ctx context.Context, client crclient.Client, hostedCluster *hyperv1.HostedCluster) ([]byte, error) {
+func WaitForGuestKubeConfig(t *testing.T, ctx context.Context, client crclient.Client, hostedCluster *hyperv1.HostedCluster, timeout time.Duration) ([]byte, error) {
 	start := time.Now()
 	t.Logf("Waiting for hostedcluster kubeconfig to be published. Namespace: %s, name: %s", hostedCluster.Namespace, hostedCluster.Name)
 	var guestKubeConfigSecret corev1.Secret
-	err := wait.PollUntil(1*time.Second, func() (done bool, err error) {
-		err = client.Get(ctx, crclient.ObjectKeyFromObject(hostedCluster), hostedCluster)
+	waiter := NewWaiter(timeout, 1*time.Second).WithObserver(DefaultObserver)
+	err := waiter.Poll(t, ctx, "guest kubeconfig published", func() (bool, string, error) {
+		err := client.Get(ctx, crclient.ObjectKeyFromObject(hostedCluster), hostedCluster)
 		if err != nil {
-			return false, nil
+			return false, "hostedcluster not found", nil
 		}
 		if hostedCluster.Status.KubeConfig == nil {
-			return false, nil
+			return false, "kubeconfig not yet published", nil
 		}
 		key := crclient.ObjectKey{
 			Namespace: hostedCluster.Namespace,
 			Name:      hostedCluster.Status.KubeConfig.Name,
 		}
 		if err := client.Get(ctx, key, &guestKubeConfigSecret); err != nil {
-			return false, nil
+			return false, "kubeconfig secret not found", nil
 		}
-		return true, nil
-	}, ctx.Done())
+		return true, "kubeconfig secret found", nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("kubeconfig didn't become available: %w", err)
 	}
@@ -100,80 +102,151 @@ func WaitForGuestKubeConfig(t *testing.T, ctx context.Context, client crclient.C
 	return data, nil
 }
 
-func WaitForGuestClient(t *testing.T, ctx context.Context, client crclient.Client, hostedCluster *hyperv1.HostedCluster) crclient.Client {
+// WaitForGuestClient returns a client connected to the guest apiserver, and a
+// cleanup func the caller must defer. If the guest apiserver isn't directly
+// reachable (e.g. it's only exposed inside the management cluster's
+// network), it transparently falls back to a port-forwarded connection; the
+// cleanup func tears that tunnel down. When no tunnel was needed, cleanup is
+// a no-op.
+func WaitForGuestClient(t *testing.T, ctx context.Context, client crclient.Client, hostedCluster *hyperv1.HostedCluster, timeout time.Duration) (crclient.Client, func()) {
 	g := NewWithT(t)
 	start := time.Now()
 
-	guestKubeConfigSecretData, err := WaitForGuestKubeConfig(t, ctx, client, hostedCluster)
+	guestKubeConfigSecretData, err := WaitForGuestKubeConfig(t, ctx, client, hostedCluster, timeout)
 	g.Expect(err).NotTo(HaveOccurred(), "couldn't get kubeconfig")
 
 	guestConfig, err := clientcmd.RESTConfigFromKubeConfig(guestKubeConfigSecretData)
 	g.Expect(err).NotTo(HaveOccurred(), "couldn't load guest kubeconfig")
 
+	cleanup := func() {}
+	if !guestAPIServerReachable(guestConfig.Host) {
+		t.Logf("Guest apiserver at %s is not directly reachable, falling back to a port-forwarded connection", guestConfig.Host)
+		tunneledConfig, portForwardCleanup, err := portForwardGuestAPIServer(t, ctx, hostedCluster, guestConfig)
+		g.Expect(err).NotTo(HaveOccurred(), "failed to set up a port-forwarded connection to the guest apiserver")
+		guestConfig = tunneledConfig
+		cleanup = portForwardCleanup
+		// Register with t.Cleanup as soon as the port-forward exists: a later
+		// g.Expect in this function can call t.Fatalf/runtime.Goexit before
+		// we ever reach the final `return ..., cleanup`, which would
+		// otherwise leak the kubectl port-forward subprocess for the life of
+		// the test binary.
+		t.Cleanup(cleanup)
+	}
+
 	t.Logf("Waiting for a successful connection to the guest apiserver")
 	var guestClient crclient.Client
-	waitForGuestClientCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
-	defer cancel()
-	err = wait.PollUntil(5*time.Second, func() (done bool, err error) {
+	waiter := NewWaiter(timeout, 5*time.Second).WithObserver(DefaultObserver)
+	err = waiter.Poll(t, ctx, "guest apiserver reachable", func() (bool, string, error) {
 		kubeClient, err := crclient.New(guestConfig, crclient.Options{Scheme: scheme})
 		if err != nil {
-			return false, nil
+			return false, err.Error(), nil
 		}
 		guestClient = kubeClient
-		return true, nil
-	}, waitForGuestClientCtx.Done())
+		return true, "connected", nil
+	})
 	g.Expect(err).NotTo(HaveOccurred(), "failed to establish a connection to the guest apiserver")
 
 	t.Logf("Successfully connected to the guest apiserver in %s", time.Since(start).Round(time.Second))
-	return guestClient
+	return guestClient, cleanup
 }
 
-func WaitForNReadyNodes(t *testing.T, ctx context.Context, client crclient.Client, n int32) []corev1.Node {
+func WaitForNReadyNodes(t *testing.T, ctx context.Context, hostClient, guestClient crclient.Client, n int32, nodePool *hyperv1.NodePool, timeout time.Duration) []corev1.Node {
 	g := NewWithT(t)
 
-	t.Logf("Waiting for nodes to become ready. Want: %v", n)
-	nodes := &corev1.NodeList{}
-	readyNodeCount := 0
-	err := wait.PollUntil(5*time.Second, func() (done bool, err error) {
-		// TODO (alberto): have ability to filter nodes by NodePool. NodePool.Status.Nodes?
-		err = client.List(ctx, nodes)
+	t.Logf("Waiting for nodes to become ready. Want: %v, nodepool: %s", n, nodePool.Name)
+	var nodepoolNodes []corev1.Node
+	waiter := NewWaiter(timeout, 5*time.Second).WithObserver(DefaultObserver)
+	err := waiter.Poll(t, ctx, "nodepool nodes ready", func() (bool, string, error) {
+		nodeNames, err := nodePoolGuestNodeNames(ctx, hostClient, nodePool)
 		if err != nil {
-			return false, nil
+			return false, err.Error(), nil
+		}
+		if nodeNames.Len() == 0 {
+			return false, "0 machines registered", nil
 		}
-		if len(nodes.Items) == 0 {
-			return false, nil
+
+		var nodes corev1.NodeList
+		if err := guestClient.List(ctx, &nodes); err != nil {
+			return false, err.Error(), nil
 		}
-		var readyNodes []string
+
+		var readyNodes []corev1.Node
 		for _, node := range nodes.Items {
+			if !nodeNames.Has(node.Name) {
+				continue
+			}
 			for _, cond := range node.Status.Conditions {
 				if cond.Type == corev1.NodeReady && cond.Status == corev1.ConditionTrue {
-					readyNodes = append(readyNodes, node.Name)
+					readyNodes = append(readyNodes, node)
 				}
 			}
 		}
+		observed := fmt.Sprintf("%d/%d ready", len(readyNodes), n)
 		if len(readyNodes) != int(n) {
-			readyNodeCount = len(readyNodes)
-			return false, nil
+			return false, observed, nil
 		}
-		t.Logf("All nodes are ready. Count: %v", len(nodes.Items))
-		return true, nil
-	}, ctx.Done())
-	g.Expect(err).NotTo(HaveOccurred(), fmt.Sprintf("failed to ensure guest nodes became ready, ready: (%d/%d): ", readyNodeCount, n))
+		t.Logf("All nodes are ready. Count: %v", len(readyNodes))
+		nodepoolNodes = readyNodes
+		return true, observed, nil
+	})
+	g.Expect(err).NotTo(HaveOccurred(), "failed to ensure guest nodes became ready")
 
 	t.Logf("All nodes for nodepool appear to be ready. Count: %v", n)
-	return nodes.Items
+	return nodepoolNodes
 }
 
-func WaitForImageRollout(t *testing.T, ctx context.Context, client crclient.Client, hostedCluster *hyperv1.HostedCluster, image string) {
+// WaitForNodePoolReady waits for a NodePool to report that it has rolled out
+// the number of nodes requested in its spec, then cross-checks that against
+// the guest nodes backing the Machines that NodePool's MachineDeployment
+// owns.
+func WaitForNodePoolReady(t *testing.T, ctx context.Context, hostClient, guestClient crclient.Client, nodePoolName crclient.ObjectKey, timeout time.Duration) {
+	g := NewWithT(t)
+
+	t.Logf("Waiting for nodepool to become ready. Namespace: %s, name: %s", nodePoolName.Namespace, nodePoolName.Name)
+	waiter := NewWaiter(timeout, 5*time.Second).WithObserver(DefaultObserver)
+
+	var nodepool hyperv1.NodePool
+	err := waiter.Poll(t, ctx, "nodepool rolled out", func() (bool, string, error) {
+		if err := hostClient.Get(ctx, nodePoolName, &nodepool); err != nil {
+			return false, err.Error(), nil
+		}
+		if nodepool.Spec.NodeCount == nil {
+			return false, "spec.nodeCount unset", nil
+		}
+		desired := *nodepool.Spec.NodeCount
+		ready := meta.IsStatusConditionTrue(nodepool.Status.Conditions, string(hyperv1.NodePoolReadyConditionType))
+		observed := fmt.Sprintf("ready=%v replicas=%d/%d updatedReplicas=%d/%d", ready, nodepool.Status.Replicas, desired, nodepool.Status.UpdatedReplicas, desired)
+		return ready && nodepool.Status.Replicas == desired && nodepool.Status.UpdatedReplicas == desired, observed, nil
+	})
+	g.Expect(err).NotTo(HaveOccurred(), fmt.Sprintf("nodepool did not become ready. Namespace: %s, name: %s", nodePoolName.Namespace, nodePoolName.Name))
+
+	nodeNames, err := nodePoolGuestNodeNames(ctx, hostClient, &nodepool)
+	g.Expect(err).NotTo(HaveOccurred(), "failed to look up machines for nodepool")
+
+	var nodes corev1.NodeList
+	g.Expect(guestClient.List(ctx, &nodes)).To(Succeed(), "failed to list guest nodes")
+	var nodepoolNodes []string
+	for _, node := range nodes.Items {
+		if nodeNames.Has(node.Name) {
+			nodepoolNodes = append(nodepoolNodes, node.Name)
+		}
+	}
+	g.Expect(len(nodepoolNodes)).To(Equal(int(*nodepool.Spec.NodeCount)), "node count does not match nodepool replicas")
+
+	t.Logf("NodePool is ready. Namespace: %s, name: %s, replicas: %d", nodePoolName.Namespace, nodePoolName.Name, nodepool.Status.Replicas)
+}
+
+func WaitForImageRollout(t *testing.T, ctx context.Context, client crclient.Client, hostedCluster *hyperv1.HostedCluster, image string, timeout time.Duration) {
 	g := NewWithT(t)
 
 	t.Logf("Waiting for hostedcluster to rollout image. Namespace: %s, name: %s, image: %s", hostedCluster.Namespace, hostedCluster.Name, image)
-	err := wait.PollUntil(10*time.Second, func() (done bool, err error) {
+	waiter := NewWaiter(timeout, 10*time.Second).WithObserver(DefaultObserver)
+	err := waiter.Poll(t, ctx, "hostedcluster image rollout", func() (bool, string, error) {
 		latest := hostedCluster.DeepCopy()
-		err = client.Get(ctx, crclient.ObjectKeyFromObject(latest), latest)
+		err := client.Get(ctx, crclient.ObjectKeyFromObject(latest), latest)
 		if err != nil {
 			t.Errorf("Failed to get hostedcluster: %v", err)
-			return false, nil
+			return false, err.Error(), nil
 		}
 
 		isAvailable := meta.IsStatusConditionTrue(latest.Status.Conditions, string(hyperv1.HostedClusterAvailable))
@@ -184,68 +257,72 @@ func WaitForImageRollout(t *testing.T, ctx context.Context, client crclient.Clie
 			latest.Status.Version.History[0].Image == latest.Status.Version.Desired.Image &&
 			latest.Status.Version.History[0].State == configv1.CompletedUpdate
 
+		observed := fmt.Sprintf("isAvailable=%v rolloutComplete=%v", isAvailable, rolloutComplete)
 		if isAvailable && rolloutComplete {
 			t.Logf("Waiting for hostedcluster rollout. Image: %s, isAvailable: %v, rolloutComplete: %v", image, isAvailable, rolloutComplete)
-			return true, nil
+			return true, observed, nil
 		}
-		return false, nil
-	}, ctx.Done())
+		return false, observed, nil
+	})
 	g.Expect(err).NotTo(HaveOccurred(), "failed waiting for image rollout")
 
 	t.Logf("Observed hostedcluster to have successfully rolled out image. Namespace: %s, name: %s, image: %s", hostedCluster.Namespace, hostedCluster.Name, image)
 }
 
-func WaitForConditionsOnHostedControlPlane(t *testing.T, ctx context.Context, client crclient.Client, hostedCluster *hyperv1.HostedCluster, image string) {
+func WaitForConditionsOnHostedControlPlane(t *testing.T, ctx context.Context, client crclient.Client, hostedCluster *hyperv1.HostedCluster, image string, timeout time.Duration) {
 	g := NewWithT(t)
 
 	t.Logf("Waiting for hostedcluster to rollout image. Namespace: %s, name: %s, image: %s", hostedCluster.Namespace, hostedCluster.Name, image)
-	err := wait.PollUntil(10*time.Second, func() (done bool, err error) {
+	waiter := NewWaiter(timeout, 10*time.Second).WithObserver(DefaultObserver)
+	err := waiter.PollConditions(t, ctx, "hostedcontrolplane conditions", func() (bool, map[string]string, error) {
 		namespace := manifests.HostedControlPlaneNamespace(hostedCluster.Namespace, hostedCluster.Name).Name
 		cp := &hyperv1.HostedControlPlane{}
-		err = client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: hostedCluster.Name}, cp)
+		err := client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: hostedCluster.Name}, cp)
 		if err != nil {
 			t.Errorf("Failed to get hostedcontrolplane: %v", err)
-			return false, nil
+			return false, nil, nil
 		}
 
-		conditions := map[hyperv1.ConditionType]bool{
-			hyperv1.HostedControlPlaneAvailable:          false,
-			hyperv1.EtcdAvailable:                        false,
-			hyperv1.KubeAPIServerAvailable:               false,
-			hyperv1.InfrastructureReady:                  false,
-			hyperv1.ValidHostedControlPlaneConfiguration: false,
+		conditions := []hyperv1.ConditionType{
+			hyperv1.HostedControlPlaneAvailable,
+			hyperv1.EtcdAvailable,
+			hyperv1.KubeAPIServerAvailable,
+			hyperv1.InfrastructureReady,
+			hyperv1.ValidHostedControlPlaneConfiguration,
 		}
 
 		isAvailable := true
-		for condition := range conditions {
+		observed := make(map[string]string, len(conditions))
+		for _, condition := range conditions {
 			conditionReady := meta.IsStatusConditionTrue(cp.Status.Conditions, string(condition))
-			conditions[condition] = conditionReady
+			observed[string(condition)] = fmt.Sprintf("%v", conditionReady)
 			if !conditionReady {
 				isAvailable = false
 			}
 		}
 
 		if isAvailable {
-			t.Logf("Waiting for all conditions to be ready: Image: %s, conditions: %v", image, conditions)
-			return true, nil
+			t.Logf("Waiting for all conditions to be ready: Image: %s, conditions: %v", image, observed)
+			return true, observed, nil
 		}
-		return false, nil
-	}, ctx.Done())
+		return false, observed, nil
+	})
 	g.Expect(err).NotTo(HaveOccurred(), "failed waiting for image rollout")
 
 	t.Logf("Observed hostedcluster to have successfully rolled out image. Namespace: %s, name: %s, image: %s", hostedCluster.Namespace, hostedCluster.Name, image)
 }
 
 // DumpGuestCluster tries to collect resources from the from the hosted cluster,
-// and logs any failures that occur.
+// and logs any failures that occur. In addition to the fixed set of resources
+// core.DumpGuestCluster knows about, it discovers every namespaced resource
+// the guest apiserver supports and dumps those too, so CI can capture the
+// full guest cluster state on failure without hard-coding a resource list.
 func DumpGuestCluster(t *testing.T, ctx context.Context, client crclient.Client, hostedCluster *hyperv1.HostedCluster, destDir string) {
 	if len(destDir) == 0 {
 		t.Logf("Skipping guest cluster dump because no dest dir was provided")
 		return
 	}
-	kubeconfigTimeout, cancel := context.WithTimeout(ctx, 10*time.Second)
-	defer cancel()
-	kubeconfig, err := WaitForGuestKubeConfig(t, kubeconfigTimeout, client, hostedCluster)
+	kubeconfig, err := WaitForGuestKubeConfig(t, ctx, client, hostedCluster, 10*time.Second)
 	if err != nil {
 		t.Errorf("Failed to get guest kubeconfig: %v", err)
 		return
@@ -277,6 +354,16 @@ func DumpGuestCluster(t *testing.T, ctx context.Context, client crclient.Client,
 		t.Errorf("Failed to dump guest cluster: %v", err)
 		return
 	}
+
+	guestConfig, err := clientcmd.RESTConfigFromKubeConfig(kubeconfig)
+	if err != nil {
+		t.Errorf("Failed to load guest kubeconfig for discovery dump: %v", err)
+		return
+	}
+	if err := dumpDiscoveredResources(ctx, t, guestConfig, dumpDir); err != nil {
+		t.Errorf("Failed to dump discovered guest cluster resources: %v", err)
+		return
+	}
 	t.Logf("Dumped guest cluster data. Dir: %s", dumpDir)
 }
 
@@ -317,18 +404,29 @@ func EnsureNodeCountMatchesNodePoolReplicas(t *testing.T, ctx context.Context, h
 			t.Fatalf("failed to get nodepool: %v", err)
 		}
 
+		nodeNames, err := nodePoolGuestNodeNames(ctx, hostClient, &nodepool)
+		if err != nil {
+			t.Fatalf("failed to look up machines for nodepool: %v", err)
+		}
+
 		var nodes corev1.NodeList
 		if err := guestClient.List(ctx, &nodes); err != nil {
 			t.Fatalf("failed to list nodes in guest cluster: %v", err)
 		}
+		var nodepoolNodeCount int
+		for _, node := range nodes.Items {
+			if nodeNames.Has(node.Name) {
+				nodepoolNodeCount++
+			}
+		}
 
 		var nodeCount int
 		if nodepool.Spec.NodeCount != nil {
 			nodeCount = int(*nodepool.Spec.NodeCount)
 		}
 
-		if nodeCount != len(nodes.Items) {
-			t.Errorf("nodepool replicas %d does not match number of nodes in cluster %d", nodeCount, len(nodes.Items))
+		if nodeCount != nodepoolNodeCount {
+			t.Errorf("nodepool replicas %d does not match number of nodes in cluster %d", nodeCount, nodepoolNodeCount)
 		}
 	})
 }
@@ -0,0 +1,252 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+// ConditionFunc reports whether the condition a Waiter is polling for has
+// been met yet. observed is recorded even when done is false, so a failed
+// wait can report the last value seen before it timed out.
+type ConditionFunc func() (done bool, observed string, err error)
+
+// ConditionsFunc is like ConditionFunc, but for waits that track several
+// named sub-conditions at once (e.g. one poll function that inspects every
+// condition on a status object). observed holds the per-condition values
+// seen on this poll.
+type ConditionsFunc func() (done bool, observed map[string]string, err error)
+
+// PollObserver is notified after every poll a Waiter performs, regardless of
+// whether the condition was met. Implementations can use it to record
+// per-condition transition timestamps for later analysis.
+type PollObserver interface {
+	Observe(condition string, observed string, pollCount int, elapsed time.Duration)
+}
+
+// conditionStats tracks what a single Poll/PollConditions call observed, so
+// it can be included in the failure report of whichever condition in the
+// same Waiter actually timed out.
+type conditionStats struct {
+	name    string
+	observed string
+	polls   int
+	elapsed time.Duration
+	err     error
+}
+
+// Waiter polls named conditions on a shared, rate-limited cadence and
+// produces a structured failure report when a condition is never met. It
+// replaces ad-hoc wait.PollUntil/PollImmediateUntil loops so that (a)
+// polling backs off automatically instead of hammering the apiserver at a
+// fixed interval, (b) callers can tune the timeout without editing this
+// package, and (c) a failed wait reports every condition it was waiting on,
+// the last value observed, the elapsed time, and the number of polls
+// performed.
+type Waiter struct {
+	limiter  workqueue.RateLimiter
+	timeout  time.Duration
+	observer PollObserver
+
+	mu         sync.Mutex
+	conditions []*conditionStats
+}
+
+// NewWaiter returns a Waiter whose conditions must each complete within
+// timeout. The first poll for a condition happens immediately; every
+// subsequent poll for that condition backs off exponentially starting from
+// baseInterval (mirroring the interval the ad-hoc loop being replaced used
+// to poll at), up to timeout, for as long as the condition keeps reporting
+// not-done. This way a condition that's close to being met is still polled
+// promptly, but a server under pressure or a condition stuck far from met
+// is polled less and less often rather than hammered at a fixed interval.
+func NewWaiter(timeout, baseInterval time.Duration) *Waiter {
+	return &Waiter{
+		limiter: workqueue.NewItemExponentialFailureRateLimiter(baseInterval, timeout),
+		timeout: timeout,
+	}
+}
+
+// WithObserver attaches a PollObserver that's notified after every poll this
+// Waiter performs.
+func (w *Waiter) WithObserver(observer PollObserver) *Waiter {
+	w.observer = observer
+	return w
+}
+
+// Poll runs fn, bounding it by both ctx and the Waiter's configured timeout,
+// until fn reports done, returns an error, or the timeout elapses. name
+// identifies the condition for observability and for the failure report.
+func (w *Waiter) Poll(t *testing.T, ctx context.Context, name string, fn ConditionFunc) error {
+	return w.poll(t, ctx, name, func() (bool, map[string]string, error) {
+		done, observed, err := fn()
+		return done, map[string]string{name: observed}, err
+	})
+}
+
+// PollConditions is like Poll, but for a single wait that tracks several
+// named sub-conditions at once; all of the per-condition values observed on
+// the final poll are included in the failure report.
+func (w *Waiter) PollConditions(t *testing.T, ctx context.Context, name string, fn ConditionsFunc) error {
+	return w.poll(t, ctx, name, fn)
+}
+
+func (w *Waiter) poll(t *testing.T, ctx context.Context, name string, fn ConditionsFunc) error {
+	waitCtx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+
+	start := time.Now()
+	stats := &conditionStats{name: name}
+
+	for {
+		stats.polls++
+
+		done, observed, err := fn()
+		stats.observed = formatObserved(observed)
+		stats.elapsed = time.Since(start)
+		if w.observer != nil {
+			w.observer.Observe(name, stats.observed, stats.polls, stats.elapsed)
+		}
+		if err != nil {
+			stats.err = err
+			break
+		}
+		if done {
+			w.limiter.Forget(name)
+			break
+		}
+
+		select {
+		case <-waitCtx.Done():
+			stats.err = waitCtx.Err()
+		case <-time.After(w.limiter.When(name)):
+			continue
+		}
+		break
+	}
+
+	w.mu.Lock()
+	w.conditions = append(w.conditions, stats)
+	w.mu.Unlock()
+
+	w.logTransitions(t, name)
+
+	if stats.err != nil {
+		w.reportFailure(t, stats)
+		return fmt.Errorf("condition %q was not met after %s (%d polls): %w", name, stats.elapsed.Round(time.Second), stats.polls, stats.err)
+	}
+	return nil
+}
+
+func formatObserved(observed map[string]string) string {
+	if len(observed) == 1 {
+		for _, v := range observed {
+			return v
+		}
+	}
+	var parts []string
+	for k, v := range observed {
+		parts = append(parts, fmt.Sprintf("%s=%s", k, v))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// reportFailure emits a structured JUnit property listing every condition
+// this Waiter was asked to wait on, its last observed value, the elapsed
+// time and the number of polls performed. CI's log scraper turns these
+// lines into JUnit test properties so HostedCluster rollout latency
+// regressions are visible across a run without parsing prose log output.
+func (w *Waiter) reportFailure(t *testing.T, failed *conditionStats) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var b strings.Builder
+	for i, c := range w.conditions {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		fmt.Fprintf(&b, "condition=%s observed=%q elapsed=%s polls=%d", c.name, c.observed, c.elapsed.Round(time.Second), c.polls)
+		if c.err != nil {
+			fmt.Fprintf(&b, " err=%q", c.err)
+		}
+	}
+	t.Logf("##junit-property name=waiter.%s value=%q", failed.name, b.String())
+}
+
+// transitionReporter is implemented by a PollObserver that can give back the
+// transition history it recorded for a condition.
+type transitionReporter interface {
+	Transitions(condition string) []Transition
+}
+
+// logTransitions emits the condition's recorded value-transition timeline as
+// a JUnit property, win or lose, so regressions in how long a HostedCluster
+// takes to move between states show up across a CI run and aren't only
+// visible when a wait times out.
+func (w *Waiter) logTransitions(t *testing.T, name string) {
+	reporter, ok := w.observer.(transitionReporter)
+	if !ok {
+		return
+	}
+	transitions := reporter.Transitions(name)
+	if len(transitions) == 0 {
+		return
+	}
+
+	var b strings.Builder
+	for i, transition := range transitions {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		fmt.Fprintf(&b, "value=%q at=%s", transition.Value, transition.FirstSeen.Format(time.RFC3339Nano))
+	}
+	t.Logf("##junit-property name=waiter.%s.transitions value=%q", name, b.String())
+}
+
+// TransitionObserver is a PollObserver that records every change in a
+// condition's observed value, with the time the new value was first seen, so
+// a timeline of state transitions can be reconstructed after a wait
+// completes. A value that comes back after a different one is recorded again.
+type TransitionObserver struct {
+	mu          sync.Mutex
+	transitions map[string][]Transition
+}
+
+// Transition is a single observed value change for a condition.
+type Transition struct {
+	Value     string
+	FirstSeen time.Time
+}
+
+// NewTransitionObserver returns an empty TransitionObserver.
+func NewTransitionObserver() *TransitionObserver {
+	return &TransitionObserver{transitions: map[string][]Transition{}}
+}
+
+// Observe implements PollObserver.
+func (o *TransitionObserver) Observe(condition string, observed string, _ int, _ time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	history := o.transitions[condition]
+	if len(history) == 0 || history[len(history)-1].Value != observed {
+		o.transitions[condition] = append(history, Transition{Value: observed, FirstSeen: time.Now()})
+	}
+}
+
+// Transitions returns the recorded value changes for condition, oldest
+// first.
+func (o *TransitionObserver) Transitions(condition string) []Transition {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]Transition(nil), o.transitions[condition]...)
+}
+
+// DefaultObserver is shared by the package's wait helpers so a single test
+// run accumulates one timeline of condition transitions across every wait it
+// performs.
+var DefaultObserver = NewTransitionObserver()